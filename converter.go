@@ -5,17 +5,22 @@ import (
 	"strings"
 )
 
+// namespaceSeparator joins labels into a namespace and separates a namespace
+// from the piece ID appended via appendToNamespace. Labels must not contain
+// it, or they would collide with that suffix.
+const namespaceSeparator = "-"
+
 // appendToNamespace appends the given label to the given namespace. This
 // operates against a contract with labelsToNamespace. Both methods use the dash
 // as separators.
 func appendToNamespace(namespace, label string) string {
-	return namespace + "-" + label
+	return namespace + namespaceSeparator + label
 }
 
 func mappingsToKeys(m map[string][]interface{}) []string {
 	var keys []string
 
-	for k, _ := range m {
+	for k := range m {
 		keys = append(keys, k)
 	}
 
@@ -23,12 +28,51 @@ func mappingsToKeys(m map[string][]interface{}) []string {
 }
 
 // labelsToNamespace creates a reproducible namespace using the given labels.
-// This operates against a contract with appendToNamespace. Both methods use the
-// dash as separators.
+// This operates against a contract with appendToNamespace. Both methods use
+// the dash as separators.
+//
+// Note that labelsToNamespace does not deduplicate labels, so label sets that
+// only differ in repetition, such as ["a", "a", "b"] and ["a", "b"], map to
+// different namespaces. It is kept around, and used unless
+// ServiceConfig.CanonicalizeLabels is set, to provide a migration window for
+// callers relying on namespaces and stored keys computed the old way. New
+// callers should enable ServiceConfig.CanonicalizeLabels and go through
+// canonicalLabelsToNamespace instead.
 func labelsToNamespace(labels ...string) string {
 	sort.Strings(labels)
 
-	namespace := strings.Join(labels, "-")
+	namespace := strings.Join(labels, namespaceSeparator)
 
 	return namespace
 }
+
+// canonicalLabelsToNamespace creates a reproducible namespace using the given
+// labels. Labels are deduplicated before being joined, so that equivalent
+// label sets, regardless of repetition or order, always produce the same
+// namespace. Empty labels and labels containing the namespace separator are
+// rejected, since the latter would collide with the piece ID suffix appended
+// by appendToNamespace. maxLabels of 0 means no limit on the number of
+// distinct labels.
+func canonicalLabelsToNamespace(maxLabels int, labels ...string) (string, error) {
+	seen := map[string]struct{}{}
+	for _, l := range labels {
+		if l == "" {
+			return "", maskAnyf(invalidLabelError, "label must not be empty")
+		}
+		if strings.Contains(l, namespaceSeparator) {
+			return "", maskAnyf(invalidLabelError, "label must not contain '%s': %s", namespaceSeparator, l)
+		}
+		seen[l] = struct{}{}
+	}
+	if maxLabels > 0 && len(seen) > maxLabels {
+		return "", maskAnyf(invalidLabelError, "must not provide more than %d labels", maxLabels)
+	}
+
+	unique := make([]string, 0, len(seen))
+	for l := range seen {
+		unique = append(unique, l)
+	}
+	sort.Strings(unique)
+
+	return strings.Join(unique, namespaceSeparator), nil
+}
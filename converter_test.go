@@ -0,0 +1,101 @@
+package configuration
+
+import (
+	"testing"
+)
+
+func Test_canonicalLabelsToNamespace(t *testing.T) {
+	testCases := []struct {
+		maxLabels     int
+		labels        []string
+		expectedValue string
+		errorMatcher  func(err error) bool
+	}{
+		// Case 0, order does not matter.
+		{
+			maxLabels:     0,
+			labels:        []string{"b", "a"},
+			expectedValue: "a-b",
+			errorMatcher:  nil,
+		},
+		// Case 1, duplicates do not create a different namespace.
+		{
+			maxLabels:     0,
+			labels:        []string{"a", "a", "b"},
+			expectedValue: "a-b",
+			errorMatcher:  nil,
+		},
+		// Case 2, an empty label is rejected.
+		{
+			maxLabels:     0,
+			labels:        []string{"a", ""},
+			expectedValue: "",
+			errorMatcher:  IsInvalidLabel,
+		},
+		// Case 3, a label containing the namespace separator is rejected, since
+		// it would collide with the piece ID suffix appended by
+		// appendToNamespace.
+		{
+			maxLabels:     0,
+			labels:        []string{"a-b"},
+			expectedValue: "",
+			errorMatcher:  IsInvalidLabel,
+		},
+		// Case 4, more labels than maxLabels allows is rejected.
+		{
+			maxLabels:     1,
+			labels:        []string{"a", "b"},
+			expectedValue: "",
+			errorMatcher:  IsInvalidLabel,
+		},
+		// Case 5, duplicates are collapsed before maxLabels is checked.
+		{
+			maxLabels:     1,
+			labels:        []string{"a", "a"},
+			expectedValue: "a",
+			errorMatcher:  nil,
+		},
+	}
+
+	for i, tc := range testCases {
+		result, err := canonicalLabelsToNamespace(tc.maxLabels, tc.labels...)
+
+		if tc.errorMatcher != nil {
+			if !tc.errorMatcher(err) {
+				t.Fatalf("case %d expected matching error, got %#v", i, err)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Fatalf("case %d expected no error, got %#v", i, err)
+		}
+		if result != tc.expectedValue {
+			t.Fatalf("case %d expected namespace %q, got %q", i, tc.expectedValue, result)
+		}
+	}
+}
+
+func Test_canonicalLabelsToNamespace_LegacyCollision(t *testing.T) {
+	// labelsToNamespace, the legacy implementation kept for the migration
+	// window, maps these two label sets to different namespaces. The
+	// canonical implementation must not.
+	legacyA := labelsToNamespace("a", "a", "b")
+	legacyB := labelsToNamespace("a", "b")
+	if legacyA == legacyB {
+		t.Fatalf("expected legacy namespaces to differ for this test to be meaningful")
+	}
+
+	canonicalA, err := canonicalLabelsToNamespace(0, "a", "a", "b")
+	if err != nil {
+		t.Fatalf("expected no error, got %#v", err)
+	}
+	canonicalB, err := canonicalLabelsToNamespace(0, "a", "b")
+	if err != nil {
+		t.Fatalf("expected no error, got %#v", err)
+	}
+
+	if canonicalA != canonicalB {
+		t.Fatalf("expected canonical namespaces to match, got %q and %q", canonicalA, canonicalB)
+	}
+}
@@ -0,0 +1,13 @@
+package configuration
+
+import (
+	"github.com/juju/errgo"
+)
+
+var invalidLabelError = errgo.New("invalid label")
+
+// IsInvalidLabel asks whether err indicates a label that is empty, exceeds
+// the configured maximum, or contains the namespace separator.
+func IsInvalidLabel(err error) bool {
+	return errgo.Cause(err) == invalidLabelError
+}
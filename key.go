@@ -8,10 +8,36 @@ func namespaceKey(namespace string) string {
 	return fmt.Sprintf("service:configuration:namespace:%s", namespace)
 }
 
+// namespacePrefixKey is the common prefix of every namespaceKey, used to walk
+// all namespaces known to the service.
+func namespacePrefixKey() string {
+	return namespaceKey("")
+}
+
 func pieceListKey(namespace string) string {
 	return fmt.Sprintf("%s:piece:list", namespaceKey(namespace))
 }
 
+// pieceWrongListKey is to hold, per piece, the number of times the piece was
+// used for a trial that ended in Service.Failure.
+func pieceWrongListKey(namespace string) string {
+	return fmt.Sprintf("%s:wrong", pieceListKey(namespace))
+}
+
+// piecePlaysKey is to hold, per piece, the number of times the piece has been
+// selected by a ruler for the given namespace. This is tracked independently
+// of the success score so rulers like ucb1Ruler can reason about how often a
+// piece has been tried versus how often it won.
+func piecePlaysKey(namespace string) string {
+	return fmt.Sprintf("%s:plays", pieceListKey(namespace))
+}
+
+// totalPlaysKey is to hold the total number of times any piece has been
+// selected for the given namespace, regardless of which piece.
+func totalPlaysKey(namespace string) string {
+	return fmt.Sprintf("%s:plays", namespaceKey(namespace))
+}
+
 // pieceUsedKey is to hold the piece ID of the piece being used recently for the
 // given namespace.
 func pieceUsedKey(namespace string) string {
@@ -22,6 +48,12 @@ func rulerListKey(namespace string) string {
 	return fmt.Sprintf("%s:ruler:list", namespaceKey(namespace))
 }
 
+// rulerWrongListKey is to hold, per ruler, the number of times the ruler was
+// used for a trial that ended in Service.Failure.
+func rulerWrongListKey(namespace string) string {
+	return fmt.Sprintf("%s:wrong", rulerListKey(namespace))
+}
+
 // rulerUsedKey is to hold the ruler ID of the ruler being used recently for the
 // given namespace.
 func rulerUsedKey(namespace string) string {
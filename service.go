@@ -1,8 +1,10 @@
 package configuration
 
 import (
+	"math"
 	"strings"
 	"sync"
+	"text/template"
 
 	"github.com/the-anna-project/context"
 	currentstage "github.com/the-anna-project/context/current/stage"
@@ -14,10 +16,22 @@ import (
 )
 
 const (
-	randomRuler  = "random"
-	highestRuler = "highest"
+	randomRuler        = "random"
+	highestRuler       = "highest"
+	epsilonGreedyRuler = "epsilon_greedy"
+	ucb1Ruler          = "ucb1"
 )
 
+// defaultEpsilon is the default probability of the epsilon-greedy ruler
+// exploring rather than exploiting.
+const defaultEpsilon = 0.1
+
+// epsilonPrecision is the granularity used to derive a uniform draw in
+// [0, 1) from random.Service's integer-only CreateMax, since it exposes no
+// float primitive. A draw of n in [0, epsilonPrecision) corresponds to the
+// uniform value n/epsilonPrecision.
+const epsilonPrecision = 1000000
+
 // ServiceConfig represents the configuration used to create a new service.
 type ServiceConfig struct {
 	// Dependencies.
@@ -26,6 +40,28 @@ type ServiceConfig struct {
 	RandomService          random.Service
 	StorageCollection      *storage.Collection
 	WorkerService          worker.Service
+
+	// Settings.
+
+	// CanonicalizeLabels enables deduplication and validation of labels before
+	// they are turned into a namespace. This changes the namespaces, and thus
+	// the storage keys, computed for label sets containing duplicates, so it
+	// defaults to false and is meant to be enabled once callers have migrated
+	// off namespaces computed the old way.
+	CanonicalizeLabels bool
+	// Epsilon is the probability used by the epsilon-greedy ruler to explore a
+	// random piece instead of exploiting the currently best known piece.
+	Epsilon float64
+	// MaxLabels limits the number of distinct labels accepted when
+	// CanonicalizeLabels is enabled. 0 means no limit.
+	MaxLabels int
+	// RestoreMerge controls whether Service.Restore merges a snapshot into the
+	// existing ruler and piece scoreboards, instead of replacing them.
+	RestoreMerge bool
+	// TemplateFuncs holds values made available to string results under the
+	// given name. A result containing e.g. "{{ .environment }}" resolves
+	// against whatever is registered here under "environment".
+	TemplateFuncs map[string]interface{}
 }
 
 // DefaultServiceConfig provides a default configuration to create a new
@@ -85,6 +121,12 @@ func DefaultServiceConfig() ServiceConfig {
 		RandomService:          randomService,
 		StorageCollection:      storageCollection,
 		WorkerService:          workerService,
+
+		// Settings.
+		CanonicalizeLabels: false,
+		Epsilon:            defaultEpsilon,
+		MaxLabels:          0,
+		RestoreMerge:       false,
 	}
 
 	return config
@@ -117,6 +159,13 @@ func NewService(config ServiceConfig) (Service, error) {
 		storage:      config.StorageCollection,
 		worker:       config.WorkerService,
 
+		// Settings.
+		canonicalizeLabels: config.CanonicalizeLabels,
+		epsilon:            config.Epsilon,
+		maxLabels:          config.MaxLabels,
+		restoreMerge:       config.RestoreMerge,
+		templateFuncs:      config.TemplateFuncs,
+
 		// Internals.
 		bootOnce:     sync.Once{},
 		closer:       make(chan struct{}, 1),
@@ -124,6 +173,7 @@ func NewService(config ServiceConfig) (Service, error) {
 		pieces:       map[string][]interface{}{},
 		rulers:       map[string]func(ctx context.Context, labels []string) (string, error){},
 		shutdownOnce: sync.Once{},
+		templates:    map[string]*template.Template{},
 	}
 
 	return newService, nil
@@ -137,6 +187,13 @@ type service struct {
 	storage      *storage.Collection
 	worker       worker.Service
 
+	// Settings.
+	canonicalizeLabels bool
+	epsilon            float64
+	maxLabels          int
+	restoreMerge       bool
+	templateFuncs      map[string]interface{}
+
 	// Internals.
 	bootOnce     sync.Once
 	closer       chan struct{}
@@ -144,14 +201,18 @@ type service struct {
 	pieces       map[string][]interface{}
 	rulers       map[string]func(ctx context.Context, labels []string) (string, error)
 	shutdownOnce sync.Once
+	templates    map[string]*template.Template
 }
 
 func (s *service) Boot() {
 	s.bootOnce.Do(func() {
 		// The following function implements the random ruler. It chooses the
 		// namespace keys identified by pseudo random indizes.
-		s.rulers[randomRuler] = func(ctx context.Context, labels []string) (string, error) {
-			namespace := labelsToNamespace(labels...)
+		s.registerDefaultRuler(randomRuler, func(ctx context.Context, labels []string) (string, error) {
+			namespace, err := s.toNamespace(labels...)
+			if err != nil {
+				return "", maskAny(err)
+			}
 			key := pieceListKey(namespace)
 
 			element, err := s.storage.Configuration.GetRandomFromScoredSet(key)
@@ -160,31 +221,180 @@ func (s *service) Boot() {
 			}
 
 			return element, nil
-		}
+		})
 		// The following function implements the highest ruler. It chooses the
-		// namespace keys having the hightest right states.
-		s.rulers[highestRuler] = func(ctx context.Context, labels []string) (string, error) {
-			namespace := labelsToNamespace(labels...)
-			key := pieceListKey(namespace)
+		// piece with the highest Laplace-smoothed success rate, so a piece that
+		// keeps failing gets passed over even if it still has the highest raw
+		// right score.
+		s.registerDefaultRuler(highestRuler, func(ctx context.Context, labels []string) (string, error) {
+			namespace, err := s.toNamespace(labels...)
+			if err != nil {
+				return "", maskAny(err)
+			}
 
-			elements, err := s.storage.Configuration.GetHighestScoredElements(key, 1)
+			pieceID, ok, err := s.bestScoredElement(pieceListKey(namespace), pieceWrongListKey(namespace))
 			if err != nil {
 				return "", maskAny(err)
 			}
-			if len(elements) != 1 {
+			if !ok {
 				// We actually want to fetch exactly one element that has the highest
-				// score applied. In case there is no element returned, there might be
-				// no element at all.
+				// success rate applied. In case there is no element returned, there
+				// might be no element at all.
 				return "", maskAny(notFoundError)
 			}
 
-			return elements[0], nil
-		}
+			return pieceID, nil
+		})
+		// The following function implements the epsilon-greedy ruler. It
+		// exploits the currently best scored piece most of the time, but
+		// explores a random piece with probability s.epsilon so the scoreboard
+		// keeps learning about pieces the highest ruler would otherwise starve.
+		s.registerDefaultRuler(epsilonGreedyRuler, func(ctx context.Context, labels []string) (string, error) {
+			namespace, err := s.toNamespace(labels...)
+			if err != nil {
+				return "", maskAny(err)
+			}
+			key := pieceListKey(namespace)
+
+			r, err := s.random.CreateMax(epsilonPrecision)
+			if err != nil {
+				return "", maskAny(err)
+			}
+
+			if float64(r) < s.epsilon*epsilonPrecision {
+				element, err := s.storage.Configuration.GetRandomFromScoredSet(key)
+				if err != nil {
+					return "", maskAny(err)
+				}
+
+				return element, nil
+			}
+
+			pieceID, ok, err := s.bestScoredElement(key, pieceWrongListKey(namespace))
+			if err != nil {
+				return "", maskAny(err)
+			}
+			if !ok {
+				return "", maskAny(notFoundError)
+			}
+
+			return pieceID, nil
+		})
+		// The following function implements the UCB1 ruler. It picks the piece
+		// maximizing the upper confidence bound mean_i + sqrt(2*ln(N)/n_i), where
+		// mean_i is the piece's average success rate, n_i is the number of
+		// times the piece has been played and N is the total number of plays
+		// within the namespace. Pieces that have never been played
+		// are picked immediately to force exploration.
+		s.registerDefaultRuler(ucb1Ruler, func(ctx context.Context, labels []string) (string, error) {
+			namespace, err := s.toNamespace(labels...)
+			if err != nil {
+				return "", maskAny(err)
+			}
+
+			scores, err := s.scoredElements(pieceListKey(namespace))
+			if err != nil {
+				return "", maskAny(err)
+			}
+			plays, err := s.scoredElements(piecePlaysKey(namespace))
+			if err != nil {
+				return "", maskAny(err)
+			}
+			total, err := s.storage.Configuration.IncrementScoredElement(totalPlaysKey(namespace), "total", 0)
+			if err != nil {
+				return "", maskAny(err)
+			}
+
+			var bestID string
+			var bestValue float64
+			for pieceID, score := range scores {
+				n := plays[pieceID]
+				if n == 0 {
+					return pieceID, nil
+				}
+
+				value := (score / n) + math.Sqrt(2*math.Log(total)/n)
+				if bestID == "" || value > bestValue {
+					bestID = pieceID
+					bestValue = value
+				}
+			}
+			if bestID == "" {
+				return "", maskAny(notFoundError)
+			}
+
+			return bestID, nil
+		})
 	})
 }
 
+// scoredElements returns every element of the scored set identified by key,
+// together with its score. storage.Service exposes no single call that
+// returns a whole scored set with scores attached, so this walks the set to
+// completion via WalkScoredSet instead.
+func (s *service) scoredElements(key string) (map[string]float64, error) {
+	elements := map[string]float64{}
+
+	err := s.storage.Configuration.WalkScoredSet(key, nil, func(element string, score float64) error {
+		elements[element] = score
+		return nil
+	})
+	if err != nil {
+		return nil, maskAny(err)
+	}
+
+	return elements, nil
+}
+
+// bestScoredElement returns the element of the scored set identified by
+// rightKey with the highest Laplace-smoothed success rate right/(right+wrong+1),
+// taking the matching wrong count from the scored set identified by wrongKey.
+// Laplace smoothing avoids favouring an element that merely has not failed
+// yet over one with a proven, but imperfect, track record. The second return
+// value is false when rightKey is empty.
+func (s *service) bestScoredElement(rightKey, wrongKey string) (string, bool, error) {
+	right, err := s.scoredElements(rightKey)
+	if err != nil {
+		return "", false, maskAny(err)
+	}
+	wrong, err := s.scoredElements(wrongKey)
+	if err != nil {
+		return "", false, maskAny(err)
+	}
+
+	var bestID string
+	var bestRate float64
+	for id, r := range right {
+		rate := r / (r + wrong[id] + 1)
+		if bestID == "" || rate > bestRate {
+			bestID = id
+			bestRate = rate
+		}
+	}
+
+	return bestID, bestID != "", nil
+}
+
+// registerDefaultRuler registers one of the built-in rulers under name,
+// guarded by s.mutex, unless a ruler is already registered under that name.
+// This keeps RegisterRuler safe to call before Boot: a caller that registers
+// a custom ruler named e.g. "highest" before Boot runs keeps their ruler
+// instead of having it silently replaced by the built-in.
+func (s *service) registerDefaultRuler(name string, ruler func(ctx context.Context, labels []string) (string, error)) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if _, ok := s.rulers[name]; ok {
+		return
+	}
+	s.rulers[name] = ruler
+}
+
 func (s *service) Create(ctx context.Context, labels []string, pieceID string, results []interface{}) error {
-	namespace := labelsToNamespace(labels...)
+	namespace, err := s.toNamespace(labels...)
+	if err != nil {
+		return maskAny(err)
+	}
 
 	// get current stage
 	var currentStage currentstage.Value
@@ -206,7 +416,14 @@ func (s *service) Create(ctx context.Context, labels []string, pieceID string, r
 			return maskAny(err)
 		}
 		if !exists {
-			for k, _ := range s.rulers {
+			s.mutex.Lock()
+			rulerIDs := make([]string, 0, len(s.rulers))
+			for k := range s.rulers {
+				rulerIDs = append(rulerIDs, k)
+			}
+			s.mutex.Unlock()
+
+			for _, k := range rulerIDs {
 				err := s.storage.Configuration.SetElementByScore(key, k, 0)
 				if err != nil {
 					return maskAny(err)
@@ -230,58 +447,83 @@ func (s *service) Create(ctx context.Context, labels []string, pieceID string, r
 		}
 	}
 
-	// Add the piece ID and the associated results to the local mapping.
+	// Add the piece ID and the associated results to the local mapping. Create
+	// may be called again for a pieceID that already has results, so any
+	// template compiled for the old results must be dropped, or Execute would
+	// keep rendering stale template text.
 	{
+		key := appendToNamespace(pieceListKey(namespace), pieceID)
+
 		s.mutex.Lock()
-		key := pieceListKey(namespace)
-		s.pieces[appendToNamespace(key, pieceID)] = results
+		s.pieces[key] = results
 		s.mutex.Unlock()
+
+		s.invalidatePieceTemplates(key)
 	}
 
 	return nil
 }
 
+// Delete removes the full set of configuration and statistics associated
+// with the given labels, including the ruler and piece scoreboards. Use
+// purgeTrialState to only purge the state scoped to the current trial.
 func (s *service) Delete(ctx context.Context, labels []string) error {
-	namespace := labelsToNamespace(labels...)
+	namespace, err := s.toNamespace(labels...)
+	if err != nil {
+		return maskAny(err)
+	}
 
-	//
-	{
-		key := rulerListKey(namespace)
-		err := s.storage.Configuration.Remove(key)
-		if err != nil {
-			return maskAny(err)
-		}
+	err = s.purgeTrialState(ctx, labels)
+	if err != nil {
+		return maskAny(err)
 	}
 
 	//
 	{
-		key := pieceListKey(namespace)
-		err := s.storage.Configuration.Remove(key)
-		if err != nil {
-			return maskAny(err)
+		keys := []string{
+			rulerListKey(namespace),
+			rulerWrongListKey(namespace),
+			pieceListKey(namespace),
+			pieceWrongListKey(namespace),
+			piecePlaysKey(namespace),
+			totalPlaysKey(namespace),
+		}
+		for _, key := range keys {
+			err := s.storage.Configuration.Remove(key)
+			if err != nil {
+				return maskAny(err)
+			}
 		}
 	}
 
 	//
 	{
-		s.mutex.Lock()
 		key := pieceListKey(namespace)
-		for k, _ := range s.pieces {
+
+		s.mutex.Lock()
+		var deleted []string
+		for k := range s.pieces {
 			if strings.HasPrefix(k, key) {
 				delete(s.pieces, k)
+				deleted = append(deleted, k)
 			}
 		}
 		s.mutex.Unlock()
+
+		for _, k := range deleted {
+			s.invalidatePieceTemplates(k)
+		}
 	}
 
 	return nil
 }
 
 func (s *service) Execute(ctx context.Context, labels []string) (string, []interface{}, error) {
-	var err error
-
 	// ruler namespace
-	namespace := labelsToNamespace(labels...)
+	namespace, err := s.toNamespace(labels...)
+	if err != nil {
+		return "", nil, maskAny(err)
+	}
 
 	// get current stage
 	var currentStage currentstage.Value
@@ -293,25 +535,21 @@ func (s *service) Execute(ctx context.Context, labels []string) (string, []inter
 		}
 	}
 
-	// find a ruler (best ruler result decides about which ruler to use)
+	// find a ruler (the ruler with the highest success rate decides about which
+	// ruler to use)
 	var rulerID string
 	{
 		if currentStage.Trial() {
-			var elements []string
-			{
-				//
-				key := rulerListKey(namespace)
-				elements, err = s.storage.Configuration.GetHighestScoredElements(key, 1)
-				if err != nil {
-					return "", nil, maskAny(err)
-				}
+			bestID, ok, err := s.bestScoredElement(rulerListKey(namespace), rulerWrongListKey(namespace))
+			if err != nil {
+				return "", nil, maskAny(err)
 			}
 
 			//
-			if len(elements) == 0 {
+			if !ok {
 				rulerID = randomRuler
 			} else {
-				rulerID = elements[0]
+				rulerID = bestID
 			}
 
 			//
@@ -338,7 +576,9 @@ func (s *service) Execute(ctx context.Context, labels []string) (string, []inter
 	var pieceID string
 	var results []interface{}
 	{
+		s.mutex.Lock()
 		ruler, ok := s.rulers[rulerID]
+		s.mutex.Unlock()
 		if !ok {
 			return "", nil, maskAnyf(notFoundError, "no ruler for key: %s", rulerID)
 		}
@@ -351,16 +591,64 @@ func (s *service) Execute(ctx context.Context, labels []string) (string, []inter
 			return "", nil, maskAny(err)
 		}
 
+		// Track how often this piece, and pieces in general, have been played so
+		// rulers such as ucb1Ruler can reason about exploration versus
+		// exploitation.
+		_, err = s.storage.Configuration.IncrementScoredElement(piecePlaysKey(namespace), pieceID, 1)
+		if err != nil {
+			return "", nil, maskAny(err)
+		}
+		_, err = s.storage.Configuration.IncrementScoredElement(totalPlaysKey(namespace), "total", 1)
+		if err != nil {
+			return "", nil, maskAny(err)
+		}
+
 		s.mutex.Lock()
-		results, _ = s.pieces[pieceID]
+		results = s.pieces[appendToNamespace(pieceListKey(namespace), pieceID)]
 		s.mutex.Unlock()
 	}
 
+	// Resolve runtime placeholders, such as "{{ .stage }}", within string
+	// results before handing them back to the caller.
+	results, err = s.interpolateResults(ctx, namespace, pieceID, results)
+	if err != nil {
+		return "", nil, maskAny(err)
+	}
+
 	return pieceID, results, nil
 }
 
 func (s *service) Failure(ctx context.Context, labels []string) error {
-	err := s.Delete(ctx, labels)
+	namespace, err := s.toNamespace(labels...)
+	if err != nil {
+		return maskAny(err)
+	}
+
+	//
+	{
+		rulerID, err := s.storage.Configuration.Get(rulerUsedKey(namespace))
+		if err != nil {
+			return maskAny(err)
+		}
+		err = s.incrementWrongScore(rulerWrongListKey(namespace), rulerID)
+		if err != nil {
+			return maskAny(err)
+		}
+	}
+
+	//
+	{
+		pieceID, err := s.storage.Configuration.Get(pieceUsedKey(namespace))
+		if err != nil {
+			return maskAny(err)
+		}
+		err = s.incrementWrongScore(pieceWrongListKey(namespace), pieceID)
+		if err != nil {
+			return maskAny(err)
+		}
+	}
+
+	err = s.purgeTrialState(ctx, labels)
 	if err != nil {
 		return maskAny(err)
 	}
@@ -368,8 +656,83 @@ func (s *service) Failure(ctx context.Context, labels []string) error {
 	return nil
 }
 
+// incrementWrongScore increments the wrong-state score of the given element
+// within the scored set identified by key, seeding the element with a score
+// of 0 first in case it was never recorded as wrong before.
+func (s *service) incrementWrongScore(key, element string) error {
+	exists, err := s.storage.Configuration.ExistsInScoredSet(key, element)
+	if err != nil {
+		return maskAny(err)
+	}
+	if !exists {
+		err := s.storage.Configuration.SetElementByScore(key, element, 0)
+		if err != nil {
+			return maskAny(err)
+		}
+	}
+
+	_, err = s.storage.Configuration.IncrementScoredElement(key, element, 1)
+	if err != nil {
+		return maskAny(err)
+	}
+
+	return nil
+}
+
+// purgeTrialState removes state scoped to the current trial, such as the
+// ruler and piece that were used, without touching the learned ruler and
+// piece scoreboards.
+func (s *service) purgeTrialState(ctx context.Context, labels []string) error {
+	namespace, err := s.toNamespace(labels...)
+	if err != nil {
+		return maskAny(err)
+	}
+
+	//
+	{
+		key := rulerUsedKey(namespace)
+		err := s.storage.Configuration.Remove(key)
+		if err != nil {
+			return maskAny(err)
+		}
+	}
+
+	//
+	{
+		key := pieceUsedKey(namespace)
+		err := s.storage.Configuration.Remove(key)
+		if err != nil {
+			return maskAny(err)
+		}
+	}
+
+	return nil
+}
+
+func (s *service) RegisterRuler(name string, ruler func(ctx context.Context, labels []string) (string, error)) error {
+	if name == "" {
+		return maskAnyf(invalidConfigError, "ruler name must not be empty")
+	}
+	if ruler == nil {
+		return maskAnyf(invalidConfigError, "ruler must not be empty")
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if _, ok := s.rulers[name]; ok {
+		return maskAnyf(invalidConfigError, "ruler already registered: %s", name)
+	}
+	s.rulers[name] = ruler
+
+	return nil
+}
+
 func (s *service) Success(ctx context.Context, labels []string) error {
-	namespace := labelsToNamespace(labels...)
+	namespace, err := s.toNamespace(labels...)
+	if err != nil {
+		return maskAny(err)
+	}
 
 	//
 	{
@@ -403,3 +766,31 @@ func (s *service) Shutdown() {
 		close(s.closer)
 	})
 }
+
+// toNamespace turns the given labels into a namespace, honouring
+// s.canonicalizeLabels and s.maxLabels. It is used instead of calling
+// labelsToNamespace or canonicalLabelsToNamespace directly so every caller
+// within the service observes the same configuration.
+func (s *service) toNamespace(labels ...string) (string, error) {
+	if s.canonicalizeLabels {
+		return canonicalLabelsToNamespace(s.maxLabels, labels...)
+	}
+
+	return labelsToNamespace(labels...), nil
+}
+
+func (s *service) UnregisterRuler(name string) error {
+	if name == "" {
+		return maskAnyf(invalidConfigError, "ruler name must not be empty")
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if _, ok := s.rulers[name]; !ok {
+		return maskAnyf(notFoundError, "ruler not registered: %s", name)
+	}
+	delete(s.rulers, name)
+
+	return nil
+}
@@ -0,0 +1,231 @@
+package configuration
+
+import (
+	"strings"
+
+	"github.com/the-anna-project/context"
+)
+
+// snapshotSchemaVersion is incremented whenever the Snapshot structure below
+// changes in a way that is not backwards compatible, so callers persisting
+// snapshots can detect and migrate old ones.
+const snapshotSchemaVersion = 1
+
+// Score captures the right (success) and wrong (failure) count tracked for
+// one ruler or piece.
+type Score struct {
+	Element string  `json:"element"`
+	Right   float64 `json:"right"`
+	Wrong   float64 `json:"wrong"`
+}
+
+// Piece pairs a piece ID with the result variables registered for it via
+// Service.Create.
+type Piece struct {
+	ID      string        `json:"id"`
+	Results []interface{} `json:"results"`
+}
+
+// Snapshot captures the learned ruler and piece scoreboards, and the
+// in-memory piece results, of a single namespace at a point in time. It is
+// JSON-serialisable so it can be persisted, inspected, or used to warm-start
+// a fresh process.
+type Snapshot struct {
+	SchemaVersion int     `json:"schema_version"`
+	Namespace     string  `json:"namespace"`
+	Rulers        []Score `json:"rulers"`
+	Pieces        []Score `json:"pieces"`
+	PieceResults  []Piece `json:"piece_results"`
+}
+
+func (s *service) Snapshot(ctx context.Context, labels []string) (*Snapshot, error) {
+	namespace, err := s.toNamespace(labels...)
+	if err != nil {
+		return nil, maskAny(err)
+	}
+
+	snapshot, err := s.snapshotNamespace(namespace)
+	if err != nil {
+		return nil, maskAny(err)
+	}
+
+	return snapshot, nil
+}
+
+func (s *service) SnapshotAll(ctx context.Context) ([]*Snapshot, error) {
+	namespaces := map[string]struct{}{}
+
+	err := s.storage.Configuration.WalkKeys(namespacePrefixKey()+"*", nil, func(key string) error {
+		rest := strings.TrimPrefix(key, namespacePrefixKey())
+		i := strings.Index(rest, ":")
+		if i == -1 {
+			return nil
+		}
+		namespaces[rest[:i]] = struct{}{}
+		return nil
+	})
+	if err != nil {
+		return nil, maskAny(err)
+	}
+
+	var snapshots []*Snapshot
+	for namespace := range namespaces {
+		snapshot, err := s.snapshotNamespace(namespace)
+		if err != nil {
+			return nil, maskAny(err)
+		}
+		snapshots = append(snapshots, snapshot)
+	}
+
+	return snapshots, nil
+}
+
+func (s *service) snapshotNamespace(namespace string) (*Snapshot, error) {
+	rulers, err := s.scoresOf(rulerListKey(namespace), rulerWrongListKey(namespace))
+	if err != nil {
+		return nil, maskAny(err)
+	}
+	pieces, err := s.scoresOf(pieceListKey(namespace), pieceWrongListKey(namespace))
+	if err != nil {
+		return nil, maskAny(err)
+	}
+
+	var pieceResults []Piece
+	{
+		prefix := pieceListKey(namespace)
+
+		s.mutex.Lock()
+		for k, v := range s.pieces {
+			if strings.HasPrefix(k, prefix) {
+				pieceResults = append(pieceResults, Piece{
+					ID:      strings.TrimPrefix(k, prefix+"-"),
+					Results: v,
+				})
+			}
+		}
+		s.mutex.Unlock()
+	}
+
+	snapshot := &Snapshot{
+		SchemaVersion: snapshotSchemaVersion,
+		Namespace:     namespace,
+		Rulers:        rulers,
+		Pieces:        pieces,
+		PieceResults:  pieceResults,
+	}
+
+	return snapshot, nil
+}
+
+// scoresOf merges the right and wrong scored sets identified by rightKey and
+// wrongKey into one Score per element.
+func (s *service) scoresOf(rightKey, wrongKey string) ([]Score, error) {
+	right, err := s.scoredElements(rightKey)
+	if err != nil {
+		return nil, maskAny(err)
+	}
+	wrong, err := s.scoredElements(wrongKey)
+	if err != nil {
+		return nil, maskAny(err)
+	}
+
+	seen := map[string]struct{}{}
+
+	var scores []Score
+	for element, right := range right {
+		scores = append(scores, Score{Element: element, Right: right, Wrong: wrong[element]})
+		seen[element] = struct{}{}
+	}
+	for element, wrong := range wrong {
+		if _, ok := seen[element]; ok {
+			continue
+		}
+		scores = append(scores, Score{Element: element, Right: 0, Wrong: wrong})
+	}
+
+	return scores, nil
+}
+
+func (s *service) Restore(ctx context.Context, labels []string, snapshot *Snapshot) error {
+	if snapshot == nil {
+		return maskAnyf(invalidConfigError, "snapshot must not be empty")
+	}
+	if snapshot.SchemaVersion != snapshotSchemaVersion {
+		return maskAnyf(invalidConfigError, "unsupported snapshot schema version: %d", snapshot.SchemaVersion)
+	}
+
+	namespace, err := s.toNamespace(labels...)
+	if err != nil {
+		return maskAny(err)
+	}
+
+	if !s.restoreMerge {
+		err := s.Delete(ctx, labels)
+		if err != nil {
+			return maskAny(err)
+		}
+	}
+
+	for _, score := range snapshot.Rulers {
+		err := s.restoreScore(rulerListKey(namespace), rulerWrongListKey(namespace), score)
+		if err != nil {
+			return maskAny(err)
+		}
+	}
+	for _, score := range snapshot.Pieces {
+		err := s.restoreScore(pieceListKey(namespace), pieceWrongListKey(namespace), score)
+		if err != nil {
+			return maskAny(err)
+		}
+	}
+
+	//
+	{
+		prefix := pieceListKey(namespace)
+
+		var restored []string
+		s.mutex.Lock()
+		for _, piece := range snapshot.PieceResults {
+			key := appendToNamespace(prefix, piece.ID)
+			s.pieces[key] = piece.Results
+			restored = append(restored, key)
+		}
+		s.mutex.Unlock()
+
+		for _, k := range restored {
+			s.invalidatePieceTemplates(k)
+		}
+	}
+
+	return nil
+}
+
+// restoreScore applies score to the right and wrong scored sets identified by
+// rightKey and wrongKey. When s.restoreMerge is true, score is added on top of
+// whatever is already tracked there instead of replacing it, so restoring a
+// snapshot never discards learning accumulated since it was taken.
+func (s *service) restoreScore(rightKey, wrongKey string, score Score) error {
+	if s.restoreMerge {
+		_, err := s.storage.Configuration.IncrementScoredElement(rightKey, score.Element, score.Right)
+		if err != nil {
+			return maskAny(err)
+		}
+		_, err = s.storage.Configuration.IncrementScoredElement(wrongKey, score.Element, score.Wrong)
+		if err != nil {
+			return maskAny(err)
+		}
+
+		return nil
+	}
+
+	err := s.storage.Configuration.SetElementByScore(rightKey, score.Element, score.Right)
+	if err != nil {
+		return maskAny(err)
+	}
+	err = s.storage.Configuration.SetElementByScore(wrongKey, score.Element, score.Wrong)
+	if err != nil {
+		return maskAny(err)
+	}
+
+	return nil
+}
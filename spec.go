@@ -80,13 +80,35 @@ type Service interface {
 	// In case Service.Create has been called without any result variables,
 	// Service.Execute returns an empty interface list as second return value.
 	// That is, Service.Execute will not return an error in case there are no
-	// result variables.
+	// result variables. String results may contain "{{ .foo }}" placeholders,
+	// resolved against ServiceConfig.TemplateFuncs and values extracted from
+	// ctx before being returned.
 	Execute(ctx context.Context, labels []string) (string, []interface{}, error)
 	// Failure implements the success stage of the service. Here statistical
 	// records can be tracked. Further all state, but statistical records generate
 	// during the execute stage, will be prurged.
 	Failure(ctx context.Context, labels []string) error
+	// RegisterRuler registers a ruler under the given name, so it participates
+	// in the ruler selection carried out by Service.Execute. Registration is
+	// safe to call before or after Service.Boot. Registering a name that is
+	// already taken, or registering an empty name, throws an error.
+	RegisterRuler(name string, ruler func(ctx context.Context, labels []string) (string, error)) error
+	// Restore seeds the ruler and piece scoreboards, and the in-memory piece
+	// results, of the namespace identified by the given labels with the given
+	// snapshot. Whether this replaces or merges into the existing state is
+	// controlled by ServiceConfig.RestoreMerge.
+	Restore(ctx context.Context, labels []string, snapshot *Snapshot) error
+	// Snapshot captures the ruler and piece scoreboards, and the in-memory
+	// piece results, of the namespace identified by the given labels.
+	Snapshot(ctx context.Context, labels []string) (*Snapshot, error)
+	// SnapshotAll captures a Snapshot of every namespace currently known to
+	// the service.
+	SnapshotAll(ctx context.Context) ([]*Snapshot, error)
 	// Success implements the success stage of the service. Here statistical
 	// records can be tracked.
 	Success(ctx context.Context, labels []string) error
+	// UnregisterRuler removes the ruler registered under the given name. Rulers
+	// no longer registered are not used by Service.Execute. Unregistering a
+	// name that is not registered throws an error.
+	UnregisterRuler(name string) error
 }
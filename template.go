@@ -0,0 +1,132 @@
+package configuration
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"text/template"
+
+	"github.com/the-anna-project/context"
+	currentstage "github.com/the-anna-project/context/current/stage"
+)
+
+// templateExtractor pulls a named value out of ctx for use in result
+// templates. The second return value indicates whether the value was
+// present, so a missing value is simply left out of the data bag; the
+// corresponding placeholder then renders as "<no value>" instead of producing
+// an error.
+type templateExtractor func(ctx context.Context) (interface{}, bool)
+
+// templateExtractors registers the context values made available to result
+// templates under a fixed name, independent of the per-service
+// ServiceConfig.TemplateFuncs.
+var templateExtractors = map[string]templateExtractor{
+	"stage": func(ctx context.Context) (interface{}, bool) {
+		return currentstage.FromContext(ctx)
+	},
+}
+
+// templateCacheKey identifies the compiled template of one specific result of
+// one specific piece within one specific namespace, so templates are only
+// ever compiled once per piece, and pieces sharing the same ID across
+// different namespaces never share a cache entry.
+func templateCacheKey(pieceKey string, index int) string {
+	return fmt.Sprintf("%s:%d", pieceKey, index)
+}
+
+// invalidatePieceTemplates drops every cached template belonging to pieceKey,
+// the same namespace-scoped key results are stored under in s.pieces. This
+// must be called whenever the results behind pieceKey are recreated or
+// deleted, or Execute would keep rendering stale template text.
+func (s *service) invalidatePieceTemplates(pieceKey string) {
+	prefix := pieceKey + ":"
+
+	s.mutex.Lock()
+	for k := range s.templates {
+		if strings.HasPrefix(k, prefix) {
+			delete(s.templates, k)
+		}
+	}
+	s.mutex.Unlock()
+}
+
+// templateData assembles the data bag result templates are executed
+// against, merging the statically registered TemplateFuncs with whatever
+// templateExtractors manage to pull out of ctx.
+func (s *service) templateData(ctx context.Context) map[string]interface{} {
+	data := map[string]interface{}{}
+
+	for k, v := range s.templateFuncs {
+		data[k] = v
+	}
+
+	for name, extractor := range templateExtractors {
+		if v, ok := extractor(ctx); ok {
+			data[name] = v
+		}
+	}
+
+	return data
+}
+
+// pieceTemplate returns the compiled template for the given piece result,
+// compiling and caching it on first use.
+func (s *service) pieceTemplate(pieceKey string, index int, raw string) (*template.Template, error) {
+	key := templateCacheKey(pieceKey, index)
+
+	s.mutex.Lock()
+	tmpl, ok := s.templates[key]
+	s.mutex.Unlock()
+	if ok {
+		return tmpl, nil
+	}
+
+	tmpl, err := template.New(key).Parse(raw)
+	if err != nil {
+		return nil, maskAny(err)
+	}
+
+	s.mutex.Lock()
+	s.templates[key] = tmpl
+	s.mutex.Unlock()
+
+	return tmpl, nil
+}
+
+// interpolateResults resolves {{ .foo }} style placeholders within string
+// results against the data provided by templateData. Non-string results
+// pass through untouched. namespace and pieceID together identify the piece
+// the results belong to, matching the key results are stored under in
+// s.pieces, so templates never leak across namespaces.
+func (s *service) interpolateResults(ctx context.Context, namespace, pieceID string, results []interface{}) ([]interface{}, error) {
+	if len(results) == 0 {
+		return results, nil
+	}
+
+	pieceKey := appendToNamespace(pieceListKey(namespace), pieceID)
+	data := s.templateData(ctx)
+
+	interpolated := make([]interface{}, len(results))
+	for i, result := range results {
+		str, ok := result.(string)
+		if !ok {
+			interpolated[i] = result
+			continue
+		}
+
+		tmpl, err := s.pieceTemplate(pieceKey, i, str)
+		if err != nil {
+			return nil, maskAny(err)
+		}
+
+		var buf bytes.Buffer
+		err = tmpl.Execute(&buf, data)
+		if err != nil {
+			return nil, maskAny(err)
+		}
+
+		interpolated[i] = buf.String()
+	}
+
+	return interpolated, nil
+}